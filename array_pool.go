@@ -1,12 +1,32 @@
 package arraypool
 
-import "fmt"
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"sort"
+	"sync/atomic"
+	"unsafe"
+)
+
+var ErrNoContiguousBlock = errors.New("no contiguous block available")
 
 type ArrayPool[T any] struct {
 	arr   []T //Arr[0]是哨兵（sentinel），不会分配出去
 	alloc int //下一次分配哪个
 	// free  []int
-	free map[int]struct{}
+	free     map[int]struct{}
+	freePeak int //free自上次重建以来的最大长度，map删除元素后不会缩容
+
+	allocCalls uint64
+	freeCalls  uint64
+
+	metrics PoolMetrics
+
+	revision atomic.Uint64 //每次Alloc、Free等修改都递增，外部缓存据此判断是否过期
 }
 
 func New[T any](cap int) *ArrayPool[T] {
@@ -24,7 +44,12 @@ func New[T any](cap int) *ArrayPool[T] {
 	}
 }
 
-func (ap *ArrayPool[T]) nextCap(oldCap int) int {
+// 设置监控，传nil关闭
+func (ap *ArrayPool[T]) SetMetrics(m PoolMetrics) {
+	ap.metrics = m
+}
+
+func nextCap(oldCap int) int {
 	doubleCap := oldCap + oldCap
 	const threshold = 256
 	if oldCap < threshold {
@@ -34,17 +59,41 @@ func (ap *ArrayPool[T]) nextCap(oldCap int) int {
 }
 
 func (ap *ArrayPool[T]) grow() {
-	newCap := ap.nextCap(len(ap.arr))
+	ap.growTo(nextCap(len(ap.arr)))
+}
+
+func (ap *ArrayPool[T]) growTo(newCap int) {
+	if ap.metrics != nil {
+		ap.metrics.RecordGrow(len(ap.arr), newCap)
+	}
 	newArray := make([]T, newCap)
 	copy(newArray, ap.arr)
 	ap.arr = newArray
 }
 
+// 每分配出去一个id记一次
+func (ap *ArrayPool[T]) recordAlloc() {
+	ap.allocCalls++
+	ap.revision.Add(1)
+	if ap.metrics != nil {
+		ap.metrics.RecordAlloc()
+	}
+}
+
+func (ap *ArrayPool[T]) recordFree() {
+	ap.freeCalls++
+	ap.revision.Add(1)
+	if ap.metrics != nil {
+		ap.metrics.RecordFree()
+	}
+}
+
 // return >=1
 func (ap *ArrayPool[T]) Alloc() int {
 	if ap.alloc < len(ap.arr) {
 		id := ap.alloc
 		ap.alloc++
+		ap.recordAlloc()
 		return id
 	}
 
@@ -56,6 +105,7 @@ func (ap *ArrayPool[T]) Alloc() int {
 	if len(ap.free) > 0 {
 		for k := range ap.free {
 			delete(ap.free, k)
+			ap.recordAlloc()
 			return k
 		}
 	}
@@ -65,15 +115,22 @@ func (ap *ArrayPool[T]) Alloc() int {
 	return ap.Alloc()
 }
 
-func (ap *ArrayPool[T]) Free(id int) {
+func (ap *ArrayPool[T]) checkID(id int) {
 	if id <= 0 || id >= ap.alloc {
 		panic(fmt.Errorf("free invalid id:%d, next alloc pos:%d", id, ap.alloc))
 	}
+}
+
+func (ap *ArrayPool[T]) Free(id int) {
+	ap.checkID(id)
 
 	ap.arr[id] = ap.arr[0] //重置为零值，防止内存泄露
 
 	if id == ap.alloc-1 {
 		ap.alloc--
+		if _, ok := ap.free[id]; !ok { //已在free里说明是重复释放，不计数
+			ap.recordFree()
+		}
 		return
 	}
 
@@ -84,6 +141,34 @@ func (ap *ArrayPool[T]) Free(id int) {
 		return
 	}
 	ap.free[id] = struct{}{}
+	ap.recordFree()
+	if len(ap.free) > ap.freePeak {
+		ap.freePeak = len(ap.free)
+	}
+}
+
+// free里真正等待复用的id数。重复释放尾部id时free里可能残留>=alloc的id，不计入
+func (ap *ArrayPool[T]) freeCount() int {
+	n := 0
+	for id := range ap.free {
+		if id < ap.alloc {
+			n++
+		}
+	}
+	return n
+}
+
+// 先拷贝出元素再释放，返回释放前的值
+func (ap *ArrayPool[T]) FreeAndReturn(id int) T {
+	ap.checkID(id)
+	v := ap.arr[id]
+	ap.Free(id)
+	return v
+}
+
+// 移出语义：调用后槽位已释放，元素归调用方所有。等价于FreeAndReturn
+func (ap *ArrayPool[T]) TakeOwnership(id int) T {
+	return ap.FreeAndReturn(id)
 }
 
 func (ap *ArrayPool[T]) Get(id int) T {
@@ -93,3 +178,414 @@ func (ap *ArrayPool[T]) Get(id int) T {
 func (ap *ArrayPool[T]) GetRef(id int) *T {
 	return &ap.arr[id]
 }
+
+type HistogramBucket struct {
+	Low, High int //闭区间[Low, High]
+	LiveCount int
+	FreeCount int
+}
+
+// 把已分配过的id区间[1, alloc)等分成buckets段，统计每段存活和已释放的数量，用于观察碎片分布
+func (ap *ArrayPool[T]) Histogram(buckets int) []HistogramBucket {
+	if buckets <= 0 {
+		panic(fmt.Errorf("invalid histogram buckets:%d", buckets))
+	}
+
+	n := ap.alloc - 1
+	if n <= 0 {
+		return nil
+	}
+	if buckets > n {
+		buckets = n
+	}
+
+	res := make([]HistogramBucket, buckets)
+	for i := range res {
+		res[i].Low = 1 + i*n/buckets
+		res[i].High = (i + 1) * n / buckets
+		res[i].LiveCount = res[i].High - res[i].Low + 1
+	}
+
+	for id := range ap.free {
+		if id >= ap.alloc {
+			continue
+		}
+		i := sort.Search(len(res), func(i int) bool { return res[i].High >= id })
+		res[i].LiveCount--
+		res[i].FreeCount++
+	}
+
+	return res
+}
+
+// 估算容纳n个元素的map[int]struct{}哈希表占用的字节数，按Go 1.24+的Swiss table布局：
+// 每个group 8个槽位（8字节控制字 + 8个int key），最大装载因子7/8，槽位数按2的幂增长。
+// 忽略directory和table头等小开销，仅为粗略估计，随Go版本变化
+func estimateFreeMapBytes(n int) int {
+	const groupSlots = 8
+	const groupSize = 8 + groupSlots*8
+	if n == 0 {
+		return 0
+	}
+	slots := groupSlots
+	for n*8 > slots*7 {
+		slots <<= 1
+	}
+	return slots / groupSlots * groupSize
+}
+
+// 按当前大小重建free，释放map历史峰值时的哈希表内存。返回估算释放的字节数。
+// 开销是O(len(free))，用于低频维护。
+func (ap *ArrayPool[T]) ShrinkFreeList() int {
+	freed := estimateFreeMapBytes(ap.freePeak) - estimateFreeMapBytes(len(ap.free))
+
+	free := make(map[int]struct{}, len(ap.free))
+	for id := range ap.free {
+		free[id] = struct{}{}
+	}
+	ap.free = free
+	ap.freePeak = len(free)
+
+	if freed < 0 {
+		return 0
+	}
+	return freed
+}
+
+// 返回所有存活id到元素指针的映射。
+// 注意：Alloc触发grow()会重新分配底层数组，之前拿到的指针随之失效
+func (ap *ArrayPool[T]) GetAllRef() map[int]*T {
+	res := make(map[int]*T, ap.alloc-1-ap.freeCount())
+	for id := 1; id < ap.alloc; id++ {
+		if _, ok := ap.free[id]; ok {
+			continue
+		}
+		res[id] = &ap.arr[id]
+	}
+	return res
+}
+
+// 把所有存活元素搬到从1开始的连续位置，返回旧id到新id的映射。
+// 会重新分配底层数组，开销较大，适合离线场景（如序列化前整理）
+func (ap *ArrayPool[T]) Compact() map[int]int {
+	live := ap.alloc - 1 - ap.freeCount()
+	newCap := live + 1
+	if newCap < 2 {
+		newCap = 2
+	}
+	newArray := make([]T, newCap)
+	remap := make(map[int]int, live)
+
+	next := 1
+	for id := 1; id < ap.alloc; id++ {
+		if _, ok := ap.free[id]; ok {
+			continue
+		}
+		newArray[next] = ap.arr[id]
+		remap[id] = next
+		next++
+	}
+
+	ap.arr = newArray
+	ap.alloc = next
+	ap.free = make(map[int]struct{})
+	ap.freePeak = 0
+	ap.revision.Add(1)
+	return remap
+}
+
+type PoolStats struct {
+	TotalSlots         int //不含哨兵
+	LiveCount          int
+	FreeCount          int     //已释放、等待复用的id数
+	FragmentationRatio float64 //FreeCount / 已分配过的id数
+	MemoryUsageBytes   int     //底层数组加上free哈希表的估算值
+	AllocCalls         uint64
+	FreeCalls          uint64
+}
+
+// 返回当前统计信息的快照，不修改池
+func (ap *ArrayPool[T]) Stats() PoolStats {
+	var zero T
+	freeCount := ap.freeCount()
+	stats := PoolStats{
+		TotalSlots:       len(ap.arr) - 1,
+		LiveCount:        ap.alloc - 1 - freeCount,
+		FreeCount:        freeCount,
+		MemoryUsageBytes: cap(ap.arr)*int(unsafe.Sizeof(zero)) + estimateFreeMapBytes(ap.freePeak),
+		AllocCalls:       ap.allocCalls,
+		FreeCalls:        ap.freeCalls,
+	}
+	if used := ap.alloc - 1; used > 0 {
+		stats.FragmentationRatio = float64(stats.FreeCount) / float64(used)
+	}
+	return stats
+}
+
+// 只遍历存活id，不读取元素，避免大对象污染cache
+func (ap *ArrayPool[T]) ForEachID(fn func(id int)) {
+	for id := 1; id < ap.alloc; id++ {
+		if _, ok := ap.free[id]; ok {
+			continue
+		}
+		fn(id)
+	}
+}
+
+// 保证能同时容纳n个存活对象而不再grow，返回是否真的扩容了
+func (ap *ArrayPool[T]) EnsureCapacity(n int) bool {
+	if n+1 <= len(ap.arr) {
+		return false
+	}
+	ap.growTo(n + 1)
+	return true
+}
+
+// 深拷贝：底层数组和free都复制一份，修改副本不影响原池。
+// 监控不会复制，副本需要自行SetMetrics
+func (ap *ArrayPool[T]) Clone() *ArrayPool[T] {
+	clone := &ArrayPool[T]{
+		arr:        make([]T, len(ap.arr)),
+		alloc:      ap.alloc,
+		free:       make(map[int]struct{}, len(ap.free)),
+		freePeak:   len(ap.free),
+		allocCalls: ap.allocCalls,
+		freeCalls:  ap.freeCalls,
+	}
+	copy(clone.arr, ap.arr)
+	for id := range ap.free {
+		clone.free[id] = struct{}{}
+	}
+	clone.revision.Store(ap.revision.Load())
+	return clone
+}
+
+const formatMaxElements = 20
+
+// %v输出摘要，%+v额外输出每个存活元素（最多formatMaxElements个）
+func (ap *ArrayPool[T]) Format(f fmt.State, verb rune) {
+	switch verb {
+	case 'v', 's':
+	default:
+		fmt.Fprintf(f, "%%!%c(ArrayPool)", verb)
+		return
+	}
+
+	freeCount := ap.freeCount()
+	//用reflect取类型名，T是接口类型时零值的%T是<nil>
+	fmt.Fprintf(f, "ArrayPool[%s]{cap: %d, alloc: %d, live: %d, free: %d", reflect.TypeFor[T](),
+		len(ap.arr)-1, ap.alloc, ap.alloc-1-freeCount, freeCount)
+	if verb == 'v' && f.Flag('+') {
+		fmt.Fprint(f, ", elements: [")
+		n := 0
+		for id := 1; id < ap.alloc; id++ {
+			if _, ok := ap.free[id]; ok {
+				continue
+			}
+			if n > 0 {
+				fmt.Fprint(f, ", ")
+			}
+			if n == formatMaxElements {
+				fmt.Fprint(f, "…")
+				break
+			}
+			fmt.Fprintf(f, "%d:%v", id, ap.arr[id]) //%v会自动调用String()
+			n++
+		}
+		fmt.Fprint(f, "]")
+	}
+	fmt.Fprint(f, "}")
+}
+
+var arrayPoolMagic = [4]byte{'A', 'P', 'O', 'L'}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// 二进制序列化，要求T是定长类型（encoding/binary可编码）。
+// 格式（小端）：magic(4) 元素大小(4) alloc(4) free数量(4) free id(每个4) arr[1:alloc]
+func (ap *ArrayPool[T]) WriteTo(w io.Writer) (int64, error) {
+	var zero T
+	size := binary.Size(zero)
+	if size < 0 {
+		return 0, fmt.Errorf("array pool element type %T is not fixed-size", zero)
+	}
+
+	if uint64(ap.alloc) > math.MaxUint32 {
+		return 0, fmt.Errorf("array pool alloc pos:%d overflows uint32", ap.alloc)
+	}
+
+	free := make([]uint32, 0, len(ap.free))
+	for id := range ap.free {
+		if id >= ap.alloc {
+			continue
+		}
+		free = append(free, uint32(id))
+	}
+	sort.Slice(free, func(i, j int) bool { return free[i] < free[j] })
+
+	cw := &countingWriter{w: w}
+	header := []uint32{uint32(size), uint32(ap.alloc), uint32(len(free))}
+	if err := binary.Write(cw, binary.LittleEndian, arrayPoolMagic); err != nil {
+		return cw.n, err
+	}
+	if err := binary.Write(cw, binary.LittleEndian, header); err != nil {
+		return cw.n, err
+	}
+	if err := binary.Write(cw, binary.LittleEndian, free); err != nil {
+		return cw.n, err
+	}
+	if err := binary.Write(cw, binary.LittleEndian, ap.arr[1:ap.alloc]); err != nil {
+		return cw.n, err
+	}
+	return cw.n, nil
+}
+
+// 从WriteTo写出的数据恢复，覆盖池中原有内容
+func (ap *ArrayPool[T]) ReadFrom(r io.Reader) (int64, error) {
+	var zero T
+	size := binary.Size(zero)
+	if size < 0 {
+		return 0, fmt.Errorf("array pool element type %T is not fixed-size", zero)
+	}
+
+	cr := &countingReader{r: r}
+	var magic [4]byte
+	if err := binary.Read(cr, binary.LittleEndian, &magic); err != nil {
+		return cr.n, err
+	}
+	if magic != arrayPoolMagic {
+		return cr.n, fmt.Errorf("invalid array pool magic:%q", magic[:])
+	}
+	var header [3]uint32
+	if err := binary.Read(cr, binary.LittleEndian, &header); err != nil {
+		return cr.n, err
+	}
+	if int(header[0]) != size {
+		return cr.n, fmt.Errorf("array pool element size mismatch:%d, want:%d", header[0], size)
+	}
+	alloc := int(header[1])
+	if alloc < 1 {
+		return cr.n, fmt.Errorf("invalid array pool alloc pos:%d", alloc)
+	}
+	if int(header[2]) > alloc-1 {
+		return cr.n, fmt.Errorf("invalid array pool free count:%d, next alloc pos:%d", header[2], alloc)
+	}
+	// 头部数据不可信，按块读取，只有真正读到数据才扩容
+	freeIDs, err := readChunked(cr, []uint32(nil), int(header[2]))
+	if err != nil {
+		return cr.n, err
+	}
+	free := make(map[int]struct{}, len(freeIDs))
+	for _, id := range freeIDs {
+		if id == 0 || int(id) >= alloc {
+			return cr.n, fmt.Errorf("invalid free id:%d, next alloc pos:%d", id, alloc)
+		}
+		free[int(id)] = struct{}{}
+	}
+	arr, err := readChunked(cr, make([]T, 1), alloc-1)
+	if err != nil {
+		return cr.n, err
+	}
+	if len(arr) < 2 {
+		arr = append(arr, zero)
+	}
+
+	ap.arr = arr
+	ap.alloc = alloc
+	ap.free = free
+	ap.freePeak = len(free)
+	ap.revision.Add(1)
+	return cr.n, nil
+}
+
+const readChunkBytes = 64 << 10
+
+// 从r读n个元素追加到dst，每次最多读readChunkBytes字节，截断的输入不会导致按头部声明的大小预先分配
+func readChunked[E any](r io.Reader, dst []E, n int) ([]E, error) {
+	var zero E
+	chunk := max(readChunkBytes/max(binary.Size(zero), 1), 1)
+	for n > 0 {
+		k := min(n, chunk)
+		start := len(dst)
+		dst = append(dst, make([]E, k)...)
+		if err := binary.Read(r, binary.LittleEndian, dst[start:]); err != nil {
+			return nil, err
+		}
+		n -= k
+	}
+	return dst, nil
+}
+
+// 在现有容量内找n个连续的空闲（已释放或未分配）id并一次性分配，返回起始id。
+// 不会grow，找不到返回ErrNoContiguousBlock，需要时先调用EnsureCapacity。最坏O(容量)
+func (ap *ArrayPool[T]) AllocContiguous(n int) (int, error) {
+	if n <= 0 {
+		panic(fmt.Errorf("invalid contiguous alloc count:%d", n))
+	}
+
+	start, run := 0, 0
+	for id := 1; id < len(ap.arr); id++ {
+		_, freed := ap.free[id]
+		if id < ap.alloc && !freed {
+			run = 0
+			continue
+		}
+		if run == 0 {
+			start = id
+		}
+		run++
+		if run == n {
+			break
+		}
+	}
+	if run < n {
+		return 0, ErrNoContiguousBlock
+	}
+
+	for id := start; id < start+n; id++ {
+		delete(ap.free, id)
+	}
+	if start+n > ap.alloc {
+		ap.alloc = start + n
+	}
+	for i := 0; i < n; i++ {
+		ap.recordAlloc()
+	}
+	return start, nil
+}
+
+func (ap *ArrayPool[T]) Revision() uint64 {
+	return ap.revision.Load()
+}
+
+// 当前版本号大于minRevision时返回所有存活元素的拷贝，否则返回nil
+func (ap *ArrayPool[T]) SnapshotAt(minRevision uint64) map[int]T {
+	if ap.revision.Load() <= minRevision {
+		return nil
+	}
+	res := make(map[int]T, ap.alloc-1-len(ap.free))
+	ap.ForEachID(func(id int) {
+		res[id] = ap.arr[id]
+	})
+	return res
+}
@@ -1,7 +1,13 @@
 package arraypool
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"math/rand"
+	"runtime"
+	"strings"
 	"testing"
 )
 
@@ -59,3 +65,612 @@ func TestArrayPool(t *testing.T) {
 	fmt.Println("sttAp:", sttAp)
 	sttAp.Free(9)
 }
+
+func TestArrayPoolHistogram(t *testing.T) {
+	ap := New[TestArrayPoolStruct](0)
+	if h := ap.Histogram(4); h != nil {
+		t.Fatalf("empty pool histogram:%v", h)
+	}
+
+	for i := 0; i < 12; i++ {
+		ap.Alloc()
+	}
+	//第一段全部释放，第三段释放一个
+	ap.Free(1)
+	ap.Free(2)
+	ap.Free(3)
+	ap.Free(8)
+
+	h := ap.Histogram(4)
+	want := []HistogramBucket{
+		{Low: 1, High: 3, LiveCount: 0, FreeCount: 3},
+		{Low: 4, High: 6, LiveCount: 3, FreeCount: 0},
+		{Low: 7, High: 9, LiveCount: 2, FreeCount: 1},
+		{Low: 10, High: 12, LiveCount: 3, FreeCount: 0},
+	}
+	if len(h) != len(want) {
+		t.Fatalf("histogram len:%d, want:%d", len(h), len(want))
+	}
+	for i := range want {
+		if h[i] != want[i] {
+			t.Fatalf("bucket %d:%+v, want:%+v", i, h[i], want[i])
+		}
+	}
+
+	h = ap.Histogram(100)
+	if len(h) != 12 {
+		t.Fatalf("histogram len:%d, want:12", len(h))
+	}
+}
+
+func BenchmarkArrayPoolAllocFree(b *testing.B) {
+	for _, n := range []int{100, 1000, 10000} {
+		b.Run(fmt.Sprintf("n=%d", n), func(b *testing.B) {
+			//固定种子，保证每次跑的释放顺序一致
+			r := rand.New(rand.NewSource(int64(n)))
+			ap := New[TestArrayPoolStruct](n)
+			ids := make([]int, n)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for j := range ids {
+					ids[j] = ap.Alloc()
+				}
+				r.Shuffle(len(ids), func(x, y int) { ids[x], ids[y] = ids[y], ids[x] })
+				for _, id := range ids {
+					ap.Free(id)
+				}
+			}
+		})
+	}
+}
+
+func TestArrayPoolShrinkFreeList(t *testing.T) {
+	const n = 1 << 15
+	ap := New[TestArrayPoolStruct](n)
+	for i := 0; i < n; i++ {
+		ap.Alloc()
+	}
+	//释放除最后一个以外的所有id，全部进入free
+	for id := 1; id < n; id++ {
+		ap.Free(id)
+	}
+	//重新分配回来，free变空但哈希表不会缩小
+	for i := 1; i < n; i++ {
+		ap.Alloc()
+	}
+	ap.Free(3)
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	if freed := ap.ShrinkFreeList(); freed <= 0 {
+		t.Fatalf("ShrinkFreeList freed:%d", freed)
+	}
+
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	if after.HeapInuse >= before.HeapInuse {
+		t.Fatalf("HeapInuse not reduced, before:%d after:%d", before.HeapInuse, after.HeapInuse)
+	}
+
+	if _, ok := ap.free[3]; !ok || len(ap.free) != 1 {
+		t.Fatalf("free lost after shrink:%v", ap.free)
+	}
+	if freed := ap.ShrinkFreeList(); freed != 0 {
+		t.Fatalf("second ShrinkFreeList freed:%d", freed)
+	}
+	if id := ap.Alloc(); id != 3 {
+		t.Fatalf("alloc after shrink:%d, want:3", id)
+	}
+}
+
+func TestArrayPoolGetAllRef(t *testing.T) {
+	ap := New[TestArrayPoolStruct](0)
+	for i := 0; i < 5; i++ {
+		ap.Alloc()
+	}
+	ap.Free(2)
+	ap.Free(5)
+
+	refs := ap.GetAllRef()
+	if len(refs) != 3 {
+		t.Fatalf("GetAllRef len:%d, want:3", len(refs))
+	}
+	for id, ptr := range refs {
+		if id == 2 || id == 5 {
+			t.Fatalf("freed id %d in GetAllRef", id)
+		}
+		ptr.Val = id * 10
+	}
+	for _, id := range []int{1, 3, 4} {
+		if v := ap.Get(id).Val; v != id*10 {
+			t.Fatalf("Get(%d).Val:%d, want:%d", id, v, id*10)
+		}
+	}
+}
+
+func TestArrayPoolCompact(t *testing.T) {
+	ap := New[TestArrayPoolStruct](0)
+	for i := 1; i <= 100; i++ {
+		ap.GetRef(ap.Alloc()).Val = i
+	}
+	//释放所有偶数id，100是最后一个，不进free
+	for id := 2; id <= 100; id += 2 {
+		ap.Free(id)
+	}
+
+	remap := ap.Compact()
+	if len(remap) != 50 {
+		t.Fatalf("remap len:%d, want:50", len(remap))
+	}
+	for oldID := 1; oldID <= 100; oldID += 2 {
+		newID, ok := remap[oldID]
+		if !ok {
+			t.Fatalf("live id %d missing from remap", oldID)
+		}
+		if newID < 1 || newID > 50 {
+			t.Fatalf("id %d remapped to %d, out of dense range", oldID, newID)
+		}
+		if v := ap.Get(newID).Val; v != oldID {
+			t.Fatalf("Get(%d).Val:%d, want:%d", newID, v, oldID)
+		}
+	}
+	if len(ap.free) != 0 {
+		t.Fatalf("free not empty after compact:%v", ap.free)
+	}
+	if id := ap.Alloc(); id != 51 {
+		t.Fatalf("alloc after compact:%d, want:51", id)
+	}
+}
+
+func TestArrayPoolCompactStaleFree(t *testing.T) {
+	ap := New[TestArrayPoolStruct](0)
+	for i := 1; i <= 5; i++ {
+		ap.GetRef(ap.Alloc()).Val = i
+	}
+	//4进free后5是尾部，alloc退到5；再释放4时4成了尾部，alloc退到4，但4仍留在free里
+	ap.Free(4)
+	ap.Free(5)
+	ap.Free(4)
+
+	remap := ap.Compact()
+	if len(remap) != 3 {
+		t.Fatalf("remap:%v, want 3 live ids", remap)
+	}
+	for id := 1; id <= 3; id++ {
+		if remap[id] != id || ap.Get(id).Val != id {
+			t.Fatalf("remap[%d]:%d Get(%d).Val:%d", id, remap[id], id, ap.Get(id).Val)
+		}
+	}
+	if id := ap.Alloc(); id != 4 {
+		t.Fatalf("alloc after compact:%d, want:4", id)
+	}
+}
+
+func TestArrayPoolStats(t *testing.T) {
+	ap := New[TestArrayPoolStruct](4)
+	ids := make([]int, 0, 10)
+	for i := 0; i < 10; i++ {
+		ids = append(ids, ap.Alloc())
+	}
+	ap.Free(ids[1])
+	ap.Free(ids[3])
+	ap.Free(ids[9])
+	ap.Free(ids[1]) //重复释放不计数
+	ap.Alloc()      //复用ids[9]，free里还剩ids[1]和ids[3]
+
+	stats := ap.Stats()
+	if stats.AllocCalls != 11 || stats.FreeCalls != 3 {
+		t.Fatalf("calls alloc:%d free:%d, want 11 and 3", stats.AllocCalls, stats.FreeCalls)
+	}
+	if int(stats.AllocCalls-stats.FreeCalls) != stats.LiveCount {
+		t.Fatalf("AllocCalls-FreeCalls:%d, LiveCount:%d", stats.AllocCalls-stats.FreeCalls, stats.LiveCount)
+	}
+	if stats.LiveCount != 8 || stats.FreeCount != 2 {
+		t.Fatalf("stats:%+v", stats)
+	}
+	if stats.TotalSlots != len(ap.arr)-1 {
+		t.Fatalf("TotalSlots:%d, want:%d", stats.TotalSlots, len(ap.arr)-1)
+	}
+	if want := 2.0 / 10.0; stats.FragmentationRatio != want {
+		t.Fatalf("FragmentationRatio:%v, want:%v", stats.FragmentationRatio, want)
+	}
+	if stats.MemoryUsageBytes <= 0 {
+		t.Fatalf("MemoryUsageBytes:%d", stats.MemoryUsageBytes)
+	}
+}
+
+func TestArrayPoolStatsStaleFree(t *testing.T) {
+	ap := New[TestArrayPoolStruct](0)
+	for i := 0; i < 5; i++ {
+		ap.Alloc()
+	}
+	ap.Free(4)
+	ap.Free(5)
+	ap.Free(4) //4留在free里，但已>=alloc
+
+	stats := ap.Stats()
+	if stats.LiveCount != 3 || stats.FreeCount != 0 {
+		t.Fatalf("stats:%+v, want LiveCount 3 FreeCount 0", stats)
+	}
+	if int(stats.AllocCalls-stats.FreeCalls) != stats.LiveCount {
+		t.Fatalf("AllocCalls-FreeCalls:%d, LiveCount:%d", stats.AllocCalls-stats.FreeCalls, stats.LiveCount)
+	}
+	if s := fmt.Sprint(ap); !strings.Contains(s, "live: 3, free: 0") {
+		t.Fatalf("Format:%s", s)
+	}
+}
+
+func TestArrayPoolFreeAndReturn(t *testing.T) {
+	ap := New[TestArrayPoolStruct](0)
+	id := ap.Alloc()
+	ap.Alloc()
+	ap.GetRef(id).Val = 42
+
+	v := ap.FreeAndReturn(id)
+	if v.Val != 42 {
+		t.Fatalf("FreeAndReturn:%+v, want Val 42", v)
+	}
+	if ap.Get(id).Val != 0 {
+		t.Fatalf("slot not zeroed after FreeAndReturn:%+v", ap.Get(id))
+	}
+	if _, ok := ap.free[id]; !ok {
+		t.Fatalf("id %d not freed", id)
+	}
+}
+
+func TestArrayPoolForEachID(t *testing.T) {
+	ap := New[TestArrayPoolStruct](0)
+	for i := 0; i < 6; i++ {
+		ap.Alloc()
+	}
+	ap.Free(1)
+	ap.Free(4)
+
+	var got []int
+	ap.ForEachID(func(id int) { got = append(got, id) })
+	want := []int{2, 3, 5, 6}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("ForEachID:%v, want:%v", got, want)
+	}
+}
+
+type benchLargeStruct struct {
+	Val int
+	_   [248]byte
+}
+
+func BenchmarkArrayPoolForEachID(b *testing.B) {
+	const n = 10000
+	ap := New[benchLargeStruct](n)
+	for i := 0; i < n; i++ {
+		ap.Alloc()
+	}
+	for id := 1; id < n; id += 3 {
+		ap.Free(id)
+	}
+
+	b.Run("ForEachID", func(b *testing.B) {
+		sum := 0
+		for i := 0; i < b.N; i++ {
+			ap.ForEachID(func(id int) { sum += id })
+		}
+	})
+	b.Run("Get", func(b *testing.B) {
+		sum := 0
+		for i := 0; i < b.N; i++ {
+			for id := 1; id < ap.alloc; id++ {
+				if _, ok := ap.free[id]; ok {
+					continue
+				}
+				v := ap.Get(id)
+				sum += v.Val
+			}
+		}
+	})
+}
+
+func TestArrayPoolEnsureCapacity(t *testing.T) {
+	ap := New[TestArrayPoolStruct](0)
+	if !ap.EnsureCapacity(1000) {
+		t.Fatal("EnsureCapacity(1000) on fresh pool did not grow")
+	}
+	if ap.EnsureCapacity(1000) || ap.EnsureCapacity(10) {
+		t.Fatal("EnsureCapacity grew when capacity was sufficient")
+	}
+
+	base := &ap.arr[0]
+	for i := 0; i < 1000; i++ {
+		ap.Alloc()
+	}
+	if &ap.arr[0] != base || len(ap.arr) != 1001 {
+		t.Fatalf("backing array reallocated, len:%d", len(ap.arr))
+	}
+}
+
+func TestArrayPoolClone(t *testing.T) {
+	ap := New[TestArrayPoolStruct](0)
+	for i := 1; i <= 5; i++ {
+		ap.GetRef(ap.Alloc()).Val = i
+	}
+	m := &CountingMetrics{}
+	ap.SetMetrics(m)
+
+	clone := ap.Clone()
+	clone.Alloc()
+	clone.Free(2)
+	clone.Free(3)
+	clone.GetRef(1).Val = 100
+
+	if _, ok := ap.free[2]; ok {
+		t.Fatal("id 2 freed in original")
+	}
+	for id := 1; id <= 5; id++ {
+		if v := ap.Get(id).Val; v != id {
+			t.Fatalf("original Get(%d).Val:%d, want:%d", id, v, id)
+		}
+	}
+	if m.Allocs.Load() != 0 {
+		t.Fatalf("clone reported into original metrics, Allocs:%d", m.Allocs.Load())
+	}
+	if len(clone.free) != 2 || clone.Get(1).Val != 100 {
+		t.Fatalf("clone state wrong, free:%v Get(1):%+v", clone.free, clone.Get(1))
+	}
+
+	//原池free曾经很大，副本的free是新建的，不该继承峰值
+	for i := 0; i < 100; i++ {
+		ap.Alloc()
+	}
+	for id := 1; id < 100; id++ {
+		ap.Free(id)
+	}
+	for i := 0; i < 90; i++ {
+		ap.Alloc()
+	}
+	if freed := ap.Clone().ShrinkFreeList(); freed != 0 {
+		t.Fatalf("ShrinkFreeList on fresh clone freed:%d, want:0", freed)
+	}
+}
+
+func TestArrayPoolTakeOwnership(t *testing.T) {
+	ap := New[TestArrayPoolStruct](2) //容量用满后Alloc才会复用free里的id
+	id := ap.Alloc()
+	ap.Alloc()
+	ap.GetRef(id).Val = 7
+
+	v := ap.TakeOwnership(id)
+	if _, ok := ap.free[id]; !ok {
+		t.Fatalf("id %d not free after TakeOwnership", id)
+	}
+
+	//槽位被复用并修改后，取走的值不受影响；反过来修改取走的值也不影响池
+	if reused := ap.Alloc(); reused != id {
+		t.Fatalf("alloc after TakeOwnership:%d, want reused id:%d", reused, id)
+	}
+	ap.GetRef(id).Val = 99
+	if v.Val != 7 {
+		t.Fatalf("taken value changed to %d after slot reuse, want 7", v.Val)
+	}
+	v.Val = 1
+	if ap.Get(id).Val != 99 {
+		t.Fatalf("pool slot changed to %d by taken value, want 99", ap.Get(id).Val)
+	}
+}
+
+type testStringerStruct struct {
+	Val int
+}
+
+func (s testStringerStruct) String() string {
+	return fmt.Sprintf("S(%d)", s.Val)
+}
+
+func TestArrayPoolFormat(t *testing.T) {
+	ap := New[TestArrayPoolStruct](0)
+	for i := 1; i <= 3; i++ {
+		ap.GetRef(ap.Alloc()).Val = i
+	}
+	ap.Free(2)
+
+	summary := fmt.Sprintf("%v", ap)
+	for _, want := range []string{"ArrayPool[arraypool.TestArrayPoolStruct]", "live: 2", "free: 1"} {
+		if !strings.Contains(summary, want) {
+			t.Fatalf("%%v output %q missing %q", summary, want)
+		}
+	}
+	if strings.Contains(summary, "elements") {
+		t.Fatalf("%%v output %q should not list elements", summary)
+	}
+
+	full := fmt.Sprintf("%+v", ap)
+	if !strings.Contains(full, "elements: [1:{1}, 3:{3}]") {
+		t.Fatalf("%%+v output %q missing elements", full)
+	}
+
+	sp := New[testStringerStruct](0)
+	for i := 0; i < formatMaxElements+5; i++ {
+		sp.GetRef(sp.Alloc()).Val = i
+	}
+	full = fmt.Sprintf("%+v", sp)
+	if !strings.Contains(full, "1:S(0)") || !strings.HasSuffix(full, ", …]}") {
+		t.Fatalf("%%+v output %q not using Stringer or not truncated", full)
+	}
+
+	if s := fmt.Sprint(New[fmt.Stringer](0)); !strings.HasPrefix(s, "ArrayPool[fmt.Stringer]") {
+		t.Fatalf("interface element type printed as %q", s)
+	}
+}
+
+func TestArrayPoolBinaryRoundTrip(t *testing.T) {
+	ap := New[int64](0)
+	for i := 1; i <= 10; i++ {
+		*ap.GetRef(ap.Alloc()) = int64(i * 100)
+	}
+	ap.Free(3)
+	ap.Free(7)
+
+	var buf bytes.Buffer
+	n, err := ap.WriteTo(&buf)
+	if err != nil {
+		t.Fatalf("WriteTo:%v", err)
+	}
+	if want := int64(4 + 3*4 + 2*4 + 10*8); n != want || int64(buf.Len()) != n {
+		t.Fatalf("WriteTo wrote:%d, buffer:%d, want:%d", n, buf.Len(), want)
+	}
+
+	got := New[int64](0)
+	m, err := got.ReadFrom(&buf)
+	if err != nil {
+		t.Fatalf("ReadFrom:%v", err)
+	}
+	if m != n {
+		t.Fatalf("ReadFrom read:%d, want:%d", m, n)
+	}
+	if got.alloc != ap.alloc || len(got.free) != 2 {
+		t.Fatalf("alloc:%d free:%v, want alloc:%d free:%v", got.alloc, got.free, ap.alloc, ap.free)
+	}
+	for id := 1; id <= 10; id++ {
+		if got.Get(id) != ap.Get(id) {
+			t.Fatalf("Get(%d):%d, want:%d", id, got.Get(id), ap.Get(id))
+		}
+	}
+	if id := got.Alloc(); id != 3 && id != 7 {
+		t.Fatalf("alloc after ReadFrom:%d, want a restored free id", id)
+	}
+
+	if _, err := New[int32](0).ReadFrom(bytes.NewReader([]byte("XXXX"))); err == nil {
+		t.Fatal("ReadFrom accepted bad magic")
+	}
+	if _, err := New[[]int](0).WriteTo(&buf); err == nil {
+		t.Fatal("WriteTo accepted variable-size element type")
+	}
+}
+
+func TestArrayPoolBinaryRoundTripStaleFree(t *testing.T) {
+	ap := New[int64](0)
+	for i := 1; i <= 5; i++ {
+		*ap.GetRef(ap.Alloc()) = int64(i)
+	}
+	ap.Free(4)
+	ap.Free(5)
+	ap.Free(4) //4留在free里，但已>=alloc
+
+	var buf bytes.Buffer
+	if _, err := ap.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo:%v", err)
+	}
+	got := New[int64](0)
+	if _, err := got.ReadFrom(&buf); err != nil {
+		t.Fatalf("ReadFrom:%v", err)
+	}
+	if got.alloc != 4 || len(got.free) != 0 {
+		t.Fatalf("alloc:%d free:%v, want alloc:4 free empty", got.alloc, got.free)
+	}
+}
+
+func TestArrayPoolReadFromHostileHeader(t *testing.T) {
+	hostile := func(alloc, free uint32) []byte {
+		var buf bytes.Buffer
+		buf.WriteString("APOL")
+		binary.Write(&buf, binary.LittleEndian, []uint32{8, alloc, free})
+		return buf.Bytes()
+	}
+
+	ap := New[int64](0)
+	if _, err := ap.ReadFrom(bytes.NewReader(hostile(0xFFFFFFF0, 0xFFFFFFF0))); err == nil {
+		t.Fatal("ReadFrom accepted free count >= alloc")
+	}
+	if _, err := ap.ReadFrom(bytes.NewReader(hostile(0xFFFFFFF0, 0))); err == nil {
+		t.Fatal("ReadFrom accepted truncated elements")
+	}
+	if _, err := ap.ReadFrom(bytes.NewReader(hostile(0xFFFFFFF0, 0xFFFFFF00))); err == nil {
+		t.Fatal("ReadFrom accepted truncated free ids")
+	}
+	if ap.alloc != 1 || len(ap.arr) != 2 {
+		t.Fatalf("pool modified by failed ReadFrom, alloc:%d len:%d", ap.alloc, len(ap.arr))
+	}
+}
+
+func TestArrayPoolAllocContiguous(t *testing.T) {
+	ap := New[TestArrayPoolStruct](8)
+	a, _ := ap.AllocContiguous(2)
+	b, _ := ap.AllocContiguous(2)
+	c, err := ap.AllocContiguous(4)
+	if err != nil || a != 1 || b != 3 || c != 5 {
+		t.Fatalf("AllocContiguous:%d %d %d err:%v, want 1 3 5", a, b, c, err)
+	}
+	if _, err := ap.AllocContiguous(1); !errors.Is(err, ErrNoContiguousBlock) {
+		t.Fatalf("AllocContiguous on full pool err:%v", err)
+	}
+
+	//释放相邻的两个块
+	ap.Free(a)
+	ap.Free(a + 1)
+	ap.Free(b)
+	ap.Free(b + 1)
+	if _, err := ap.AllocContiguous(5); !errors.Is(err, ErrNoContiguousBlock) {
+		t.Fatalf("AllocContiguous(5) err:%v", err)
+	}
+	start, err := ap.AllocContiguous(2)
+	if err != nil || start != 1 {
+		t.Fatalf("AllocContiguous(2):%d err:%v, want 1", start, err)
+	}
+	if start, err = ap.AllocContiguous(2); err != nil || start != 3 {
+		t.Fatalf("AllocContiguous(2):%d err:%v, want 3", start, err)
+	}
+	if len(ap.free) != 0 {
+		t.Fatalf("free not empty:%v", ap.free)
+	}
+	if stats := ap.Stats(); int(stats.AllocCalls-stats.FreeCalls) != stats.LiveCount {
+		t.Fatalf("stats out of sync:%+v", stats)
+	}
+
+	//块跨越alloc指针
+	tail := New[TestArrayPoolStruct](5)
+	tail.Alloc()
+	tail.Alloc()
+	tail.Free(1)
+	if start, err := tail.AllocContiguous(3); err != nil || start != 3 {
+		t.Fatalf("AllocContiguous(3):%d err:%v, want 3", start, err)
+	}
+	if id := tail.Alloc(); id != 1 {
+		t.Fatalf("alloc after contiguous:%d, want 1", id)
+	}
+}
+
+func TestArrayPoolRevision(t *testing.T) {
+	ap := New[TestArrayPoolStruct](0)
+	last := ap.Revision()
+	bumped := func(op string) {
+		t.Helper()
+		rev := ap.Revision()
+		if rev <= last {
+			t.Fatalf("revision after %s:%d, previous:%d", op, rev, last)
+		}
+		last = rev
+	}
+
+	id := ap.Alloc()
+	bumped("Alloc")
+	ap.Alloc()
+	bumped("Alloc")
+	ap.Free(id)
+	bumped("Free")
+	ap.Free(id) //重复释放不改变状态
+	if ap.Revision() != last {
+		t.Fatalf("revision bumped by double free")
+	}
+	ap.Compact()
+	bumped("Compact")
+
+	if snap := ap.SnapshotAt(last); snap != nil {
+		t.Fatalf("SnapshotAt(current):%v, want nil", snap)
+	}
+	ap.GetRef(1).Val = 9
+	snap := ap.SnapshotAt(last - 1)
+	if len(snap) != 1 || snap[1].Val != 9 {
+		t.Fatalf("SnapshotAt:%v", snap)
+	}
+}
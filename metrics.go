@@ -0,0 +1,29 @@
+package arraypool
+
+import "sync/atomic"
+
+// 监控接口，方便接入Prometheus、OTel等，本包不引入任何监控依赖
+type PoolMetrics interface {
+	RecordAlloc()
+	RecordFree()
+	RecordGrow(oldCap, newCap int)
+}
+
+// PoolMetrics的参考实现，用原子计数器记录调用次数
+type CountingMetrics struct {
+	Allocs atomic.Uint64
+	Frees  atomic.Uint64
+	Grows  atomic.Uint64
+}
+
+func (m *CountingMetrics) RecordAlloc() {
+	m.Allocs.Add(1)
+}
+
+func (m *CountingMetrics) RecordFree() {
+	m.Frees.Add(1)
+}
+
+func (m *CountingMetrics) RecordGrow(oldCap, newCap int) {
+	m.Grows.Add(1)
+}
@@ -0,0 +1,32 @@
+package arraypool
+
+import "testing"
+
+func TestCountingMetrics(t *testing.T) {
+	m := &CountingMetrics{}
+	ap := New[TestArrayPoolStruct](0)
+	ap.SetMetrics(m)
+
+	for i := 0; i < 5; i++ {
+		ap.Alloc() //底层数组长度2 -> 4 -> 8，grow两次
+	}
+	ap.Free(2)
+	ap.Free(5)
+	ap.Free(2) //重复释放不记录
+
+	if got := m.Allocs.Load(); got != 5 {
+		t.Fatalf("Allocs:%d, want:5", got)
+	}
+	if got := m.Frees.Load(); got != 2 {
+		t.Fatalf("Frees:%d, want:2", got)
+	}
+	if got := m.Grows.Load(); got != 2 {
+		t.Fatalf("Grows:%d, want:2", got)
+	}
+
+	ap.SetMetrics(nil)
+	ap.Alloc()
+	if got := m.Allocs.Load(); got != 5 {
+		t.Fatalf("Allocs after SetMetrics(nil):%d, want:5", got)
+	}
+}
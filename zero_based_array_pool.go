@@ -0,0 +1,72 @@
+package arraypool
+
+import "fmt"
+
+// 从0开始分配id的ArrayPool。哨兵（零值）单独存放在zero字段，不占用arr[0]，
+// 代价是调用方不能再用0表示无效id。非线程安全。
+type ZeroBasedArrayPool[T any] struct {
+	arr   []T
+	zero  T   //哨兵，释放时用来重置元素
+	alloc int //下一次分配哪个
+	free  map[int]struct{}
+}
+
+func NewZeroBased[T any](cap int) *ZeroBasedArrayPool[T] {
+	if cap < 0 {
+		panic("cap is less than zero")
+	}
+	if cap == 0 {
+		cap = 1
+	}
+	return &ZeroBasedArrayPool[T]{
+		arr:  make([]T, cap),
+		free: make(map[int]struct{}),
+	}
+}
+
+func (ap *ZeroBasedArrayPool[T]) grow() {
+	newArray := make([]T, nextCap(len(ap.arr)))
+	copy(newArray, ap.arr)
+	ap.arr = newArray
+}
+
+// return >=0
+func (ap *ZeroBasedArrayPool[T]) Alloc() int {
+	if ap.alloc < len(ap.arr) {
+		id := ap.alloc
+		ap.alloc++
+		return id
+	}
+
+	for k := range ap.free {
+		delete(ap.free, k)
+		return k
+	}
+
+	ap.grow()
+
+	return ap.Alloc()
+}
+
+func (ap *ZeroBasedArrayPool[T]) Free(id int) {
+	if id < 0 || id >= ap.alloc {
+		panic(fmt.Errorf("free invalid id:%d, next alloc pos:%d", id, ap.alloc))
+	}
+
+	ap.arr[id] = ap.zero //重置为零值，防止内存泄露
+
+	if id == ap.alloc-1 {
+		ap.alloc--
+		return
+	}
+
+	ap.free[id] = struct{}{}
+}
+
+func (ap *ZeroBasedArrayPool[T]) Get(id int) T {
+	return ap.arr[id]
+}
+
+func (ap *ZeroBasedArrayPool[T]) GetRef(id int) *T {
+	return &ap.arr[id]
+}
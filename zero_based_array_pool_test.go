@@ -0,0 +1,50 @@
+package arraypool
+
+import "testing"
+
+func TestZeroBasedArrayPool(t *testing.T) {
+	ap := NewZeroBased[TestArrayPoolStruct](0)
+	id0 := ap.Alloc()
+	if id0 != 0 {
+		t.Fatalf("first alloc:%d, want:0", id0)
+	}
+	id1 := ap.Alloc()
+	ap.Alloc()
+
+	ap.GetRef(id0).Val = 10
+	ap.GetRef(id1).Val = 11
+	if ap.Get(id0).Val != 10 || ap.Get(id1).Val != 11 {
+		t.Fatalf("Get(0):%+v Get(1):%+v", ap.Get(id0), ap.Get(id1))
+	}
+
+	ap.Free(id0)
+	if ap.Get(id0).Val != 0 {
+		t.Fatalf("id 0 not reset after Free:%+v", ap.Get(id0))
+	}
+	if ap.zero.Val != 0 {
+		t.Fatalf("sentinel modified:%+v", ap.zero)
+	}
+	if ap.Get(id1).Val != 11 {
+		t.Fatalf("Get(1) changed after freeing 0:%+v", ap.Get(id1))
+	}
+
+	ap.Alloc() //数组末尾还有空位，先用掉
+	if id := ap.Alloc(); id != 0 {
+		t.Fatalf("alloc after free:%d, want reused 0", id)
+	}
+}
+
+func TestZeroBasedArrayPoolFreeInvalid(t *testing.T) {
+	ap := NewZeroBased[TestArrayPoolStruct](4)
+	ap.Alloc()
+	for _, id := range []int{-1, 1} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("Free(%d) did not panic", id)
+				}
+			}()
+			ap.Free(id)
+		}()
+	}
+}